@@ -1,35 +1,39 @@
 package archive
 
 import (
-	"archive/tar"
-	"compress/gzip"
-	"encoding/csv"
-	"errors"
+	"bytes"
 	"io"
-	"io/ioutil"
-	"mime"
-	"net/http"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
 	"sync"
-	"time"
 
-	"github.com/golang/gddo/httputil/header"
-	"github.com/h2non/filetype"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
 	"gopkg.in/kothar/brotli-go.v0/enc"
 )
 
-// package level errors
-var (
-	ErrPathIsDirectory          = errors.New("path is a directory")
-	ErrPathIsNotDirectory       = errors.New("path is not a directory")
-	ErrArchiverHasBeenDestroyed = errors.New("archiver has been destroyed")
-	ErrNothingToArchive         = errors.New("nothing to archive")
-	ErrContentTypeNotFound      = errors.New("content type not found")
-)
+// defaultMinCompressRatio is the MinCompressRatio CompressOptions uses when left
+// at zero: a sidecar is only written if the sampled prefix compresses to under
+// 80% of its size.
+const defaultMinCompressRatio = 0.8
+
+// compressSampleSize is how much of a file compressFile samples before committing
+// to the full .gz/.br/.zst encode.
+const compressSampleSize = 4096
+
+// CompressOptions tunes CompressFilesWithOptions' encoders and concurrency.
+// The zero value is what CompressFiles uses.
+type CompressOptions struct {
+	GzipLevel        int     // passed to pgzip.NewWriterLevel; 0 means pgzip.BestCompression
+	BrotliQuality    int     // passed to the brotli encoder; 0 means the library default
+	ZstdLevel        int     // zstd.EncoderLevelFromZstd level; 0 means the library default
+	Parallelism      int     // files compressed concurrently; 0 or less means runtime.GOMAXPROCS(0)
+	MinSize          int64   // files smaller than this are skipped entirely; 0 disables the floor
+	MinCompressRatio float64 // compressed/original size a sidecar must beat to be written; 0 means defaultMinCompressRatio
+}
 
 // CompressWebserverFiles recursively zips common webserver files in a given directory structure
 func CompressWebserverFiles(dir string) ([]string, error) {
@@ -40,296 +44,207 @@ func CompressWebserverFiles(dir string) ([]string, error) {
 
 // CompressFiles recursively zips of all regex matched files in a given directory structure
 func CompressFiles(dir string, rgx *regexp.Regexp) ([]string, error) {
+	return CompressFilesWithOptions(dir, rgx, CompressOptions{})
+}
+
+// CompressFilesWithOptions recursively writes .gz, .br, and .zst siblings for
+// every rgx-matched file in dir (each skipped where compressFile's sample does
+// not beat the ratio), as CompressFiles does, but lets the caller tune
+// compression levels and the encoding worker pool via opts. Independent files
+// are compressed concurrently; gzip encoding itself is also block-parallel via
+// pgzip, which is the bottleneck CompressFiles hit on large assets.
+func CompressFilesWithOptions(dir string, rgx *regexp.Regexp, opts CompressOptions) ([]string, error) {
 	fileInfo, err := os.Stat(filepath.Clean(dir))
 	if err != nil {
 		return nil, err
 	} else if !fileInfo.IsDir() {
 		return nil, ErrPathIsNotDirectory
 	}
-	var (
-		matches = []string{}
-		gzw     *gzip.Writer
-		brw     *enc.BrotliWriter
-	)
+	var matches []string
 	err = filepath.Walk(dir, func(p string, fileInfo os.FileInfo, err error) error {
-		if err == nil && !fileInfo.IsDir() && rgx.FindString(fileInfo.Name()) != "" {
-			inputFile, err := os.Open(p)
-			if err != nil {
-				return err
-			}
-			defer inputFile.Close()
+		if err == nil && !fileInfo.IsDir() && rgx.FindString(fileInfo.Name()) != "" &&
+			filepath.Ext(p) != ".gz" && filepath.Ext(p) != ".br" && filepath.Ext(p) != ".zst" &&
+			(opts.MinSize <= 0 || fileInfo.Size() >= opts.MinSize) {
 			matches = append(matches, p)
-			if filepath.Ext(p) != ".gz" && filepath.Ext(p) != ".br" {
-				gzOut, err := os.Create(p + ".gz")
-				if err != nil {
-					return err
-				}
-				defer gzOut.Close()
-				gzw, err = gzip.NewWriterLevel(gzOut, gzip.BestCompression)
-				if err != nil {
-					return err
-				}
-				io.Copy(gzw, inputFile)
-				gzw.Close()
-				brOut, err := os.Create(p + ".br")
-				if err != nil {
-					return err
-				}
-				defer brOut.Close()
-				brw = enc.NewBrotliWriter(nil, brOut)
-				inputFile.Seek(0, 0)
-				io.Copy(brw, inputFile)
-				brw.Close()
-			}
 		}
-		return nil
+		return err
 	})
-	return matches, err
-}
-
-type fileHandler struct {
-	mtx              *sync.RWMutex
-	rootDir          http.Dir
-	contentTypeCache map[string]string
-}
-
-// FileServer will search for and serve compressed files if they are available
-func FileServer(root http.Dir) http.Handler {
-	return &fileHandler{
-		mtx:              &sync.RWMutex{},
-		rootDir:          root,
-		contentTypeCache: map[string]string{},
-	}
-}
-
-func (f *fileHandler) getCachedContentType(p string) (string, error) {
-	f.mtx.RLock()
-	val, exists := f.contentTypeCache[p]
-	f.mtx.RUnlock()
-	if !exists {
-		return val, ErrContentTypeNotFound
-	}
-	return val, nil
-}
-
-func (f *fileHandler) cacheContentType(p, contentType string) {
-	f.mtx.Lock()
-	f.contentTypeCache[p] = contentType
-	f.mtx.Unlock()
-	return
-}
-
-func (f *fileHandler) determineContentType(p string, file http.File) string {
-	contentType, _ := f.getCachedContentType(p)
-	if contentType != "" {
-		return contentType
-	}
-	contentType = mime.TypeByExtension(filepath.Ext(p))
-	if contentType != "" {
-		f.cacheContentType(p, contentType)
-		return contentType
-	}
-	typeMatch, _ := filetype.MatchFile(p)
-	if typeMatch.MIME.Value != "" {
-		f.cacheContentType(p, typeMatch.MIME.Value)
-		return typeMatch.MIME.Value
+	if err != nil {
+		return nil, err
 	}
-	var size int
-	fileInfo, err := file.Stat()
-	if err != nil && fileInfo.Size() < 512 {
-		size = int(fileInfo.Size())
-	} else {
-		size = 512
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
 	}
-	bytes := make([]byte, size)
-	file.Read(bytes)
-	contentType = http.DetectContentType(bytes)
-	f.cacheContentType(p, contentType)
-	return contentType
-}
-
-var (
-	encoders   = []string{"br", "gzip", ""}
-	extensions = []string{".br", ".gz", ""}
-)
-
-func (f *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	tryServingContent := func(enc, ext string) error {
-		p := r.URL.Path
-		if !strings.HasPrefix(p, "/") {
-			p = "/" + p
-		}
-		p = path.Clean(p)
-		if p == "/" {
-			p = "/index.html"
-		}
-		originalPath := p
-		p = filepath.FromSlash(p + ext)
-		file, err := f.rootDir.Open(p)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		fileInfo, err := file.Stat()
-		if err != nil {
-			return err
-		}
-		if fileInfo.IsDir() {
-			return ErrPathIsDirectory
-		}
-		w.Header().Set("Content-Encoding", enc)
-		w.Header().Set("Content-Type", f.determineContentType(originalPath, file))
-		http.ServeContent(w, r, r.URL.Path, fileInfo.ModTime(), file)
-		return nil
-	}
-	specs := header.ParseAccept(r.Header, "Accept-Encoding")
-	for i := range encoders {
-		if len(specs) == 0 {
-			if tryServingContent(encoders[i], extensions[i]) == nil {
-				return
-			}
-		}
-		for _, spec := range specs {
-			if spec.Value == encoders[i] && spec.Q > 0 || extensions[i] == "" {
-				if tryServingContent(encoders[i], extensions[i]) == nil {
-					return
+	var (
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, parallelism)
+		mtx      sync.Mutex
+		firstErr error
+	)
+	for _, p := range matches {
+		p := p
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := compressFile(p, opts); err != nil {
+				mtx.Lock()
+				if firstErr == nil {
+					firstErr = err
 				}
+				mtx.Unlock()
 			}
-		}
+		}()
 	}
-	http.NotFound(w, r)
+	wg.Wait()
+	return matches, firstErr
 }
 
-type tempFile struct {
-	name   string
-	object *os.File
-}
-
-// Archiver is used to create tar.gz archives
-type Archiver struct {
-	mtx         *sync.Mutex
-	filelist    []tempFile
-	destroyChan chan struct{}
-}
-
-// NewArchiver creates an archiver
-func NewArchiver() *Archiver {
-	archiver := &Archiver{
-		mtx:         &sync.Mutex{},
-		filelist:    make([]tempFile, 0),
-		destroyChan: make(chan struct{}, 1),
+// compressFile writes p's .gz, .br, and .zst siblings using opts' encoder
+// settings, first sampling the first compressSampleSize bytes through each
+// encoder and skipping a sidecar entirely if it wouldn't beat
+// opts.MinCompressRatio. This avoids spending disk on already-compressed assets
+// (woff2, minified JSON, ...) that serve at a negative benefit;
+// fileHandler.ServeHTTP already tolerates a missing sidecar via its open-fail
+// fallthrough, so skipping here is invisible to callers.
+func compressFile(p string, opts CompressOptions) error {
+	inputFile, err := os.Open(p)
+	if err != nil {
+		return err
 	}
-	return archiver
-}
+	defer inputFile.Close()
 
-// Destroy closes destroyChan to signal the destruction of this Archiver
-func (a *Archiver) Destroy() {
-	a.mtx.Lock()
-	select {
-	case <-a.destroyChan:
-	default:
-		close(a.destroyChan)
+	minRatio := opts.MinCompressRatio
+	if minRatio <= 0 {
+		minRatio = defaultMinCompressRatio
 	}
-	a.mtx.Unlock()
-}
 
-func (a *Archiver) isDestroyed() bool {
-	select {
-	case <-a.destroyChan:
-		return true
-	default:
-		return false
+	gzLevel := opts.GzipLevel
+	if gzLevel == 0 {
+		gzLevel = pgzip.BestCompression
+	}
+	brParams := enc.NewBrotliParams()
+	if opts.BrotliQuality > 0 {
+		brParams.SetQuality(opts.BrotliQuality)
+	}
+	var zstdOpts []zstd.EOption
+	if opts.ZstdLevel > 0 {
+		zstdOpts = append(zstdOpts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.ZstdLevel)))
 	}
-}
-
-func (a *Archiver) deleteFileWhenDestroyed(filename string) {
-	<-a.destroyChan
-	os.Remove(filename)
-}
 
-// AddCSV creates a temporary csv file to be archived when CreateArchive() is called
-func (a *Archiver) AddCSV(filename string, lines [][]string) error {
-	a.mtx.Lock()
-	defer a.mtx.Unlock()
-	// ensure that the archiver is still valid
-	if a.isDestroyed() {
-		return ErrArchiverHasBeenDestroyed
+	sample := make([]byte, compressSampleSize)
+	n, err := io.ReadFull(inputFile, sample)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
 	}
-	// create a temporary file
-	file, err := ioutil.TempFile("", "go_archiver_")
+	sample = sample[:n]
+
+	gzRatio, err := sampleCompressRatio(sample, func(w io.Writer) (io.WriteCloser, error) {
+		return pgzip.NewWriterLevel(w, gzLevel)
+	})
 	if err != nil {
 		return err
 	}
-	go a.deleteFileWhenDestroyed(file.Name())
-	// encode information into temporary csv file
-	writer := csv.NewWriter(file)
-	writer.WriteAll(lines)
-	err = writer.Error()
+	brRatio, err := sampleCompressRatio(sample, func(w io.Writer) (io.WriteCloser, error) {
+		return enc.NewBrotliWriter(brParams, w), nil
+	})
 	if err != nil {
 		return err
 	}
-	// move cursor back to the beginning of the temporary file
-	file.Seek(0, 0)
-	// add temporary file into file list
-	filename = strings.Split(filename, ".")[0] + ".csv"
-	a.filelist = append(a.filelist, tempFile{
-		name:   filename,
-		object: file,
+	zstdRatio, err := sampleCompressRatio(sample, func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, zstdOpts...)
 	})
-	return nil
-}
-
-// CreateArchive moves all pending temporary files into a tar.gz
-func (a *Archiver) CreateArchive(p string) error {
-	a.mtx.Lock()
-	defer a.mtx.Unlock()
-	// no need to continue if there is nothing to archive
-	if len(a.filelist) == 0 {
-		return ErrNothingToArchive
-	}
-	// create an empty tar.gz file
-	p = strings.Split(p, ".")[0] + ".tar.gz"
-	outputFile, err := os.Create(p)
 	if err != nil {
 		return err
 	}
-	defer outputFile.Close()
-	// create the gzip encoder
-	gzw := gzip.NewWriter(outputFile)
-	defer gzw.Close()
-	// create the tar encoder
-	trw := tar.NewWriter(gzw)
-	defer trw.Close()
-	// iterate through every temporary file
-	for _, file := range a.filelist {
-		// prepare file deletion in case of an early exit
-		// note: this is safe to call more than once
-		defer os.Remove(file.object.Name())
-		// feed fileInfo into tar.WriteHeader()
-		fileInfo, err := file.object.Stat()
+	writeGz := len(sample) == 0 || gzRatio < minRatio
+	writeBr := len(sample) == 0 || brRatio < minRatio
+	writeZstd := len(sample) == 0 || zstdRatio < minRatio
+	if !writeGz && !writeBr && !writeZstd {
+		return nil
+	}
+
+	if writeGz {
+		if _, err := inputFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		gzOut, err := os.Create(p + ".gz")
 		if err != nil {
 			return err
 		}
-		header, err := tar.FileInfoHeader(fileInfo, file.name)
+		defer gzOut.Close()
+		gzw, err := pgzip.NewWriterLevel(gzOut, gzLevel)
 		if err != nil {
 			return err
 		}
-		// change the filename as the temporary filename is not valid
-		header.Name = file.name
-		header.ModTime = time.Now()
-		header.AccessTime = time.Now()
-		header.ChangeTime = time.Now()
-		err = trw.WriteHeader(header)
+		if _, err := io.Copy(gzw, inputFile); err != nil {
+			return err
+		}
+		if err := gzw.Close(); err != nil {
+			return err
+		}
+	}
+
+	if writeBr {
+		if _, err := inputFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		brOut, err := os.Create(p + ".br")
+		if err != nil {
+			return err
+		}
+		defer brOut.Close()
+		brw := enc.NewBrotliWriter(brParams, brOut)
+		if _, err := io.Copy(brw, inputFile); err != nil {
+			return err
+		}
+		if err := brw.Close(); err != nil {
+			return err
+		}
+	}
+
+	if writeZstd {
+		if _, err := inputFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		zstdOut, err := os.Create(p + ".zst")
 		if err != nil {
 			return err
 		}
-		// push all file data into the tar encoder
-		_, err = io.Copy(trw, file.object)
+		defer zstdOut.Close()
+		zstdw, err := zstd.NewWriter(zstdOut, zstdOpts...)
 		if err != nil {
 			return err
 		}
-		// remove the object now that we are finished
-		os.Remove(file.object.Name())
+		if _, err := io.Copy(zstdw, inputFile); err != nil {
+			return err
+		}
+		if err := zstdw.Close(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+// sampleCompressRatio runs sample through the writer newEncoder builds and
+// returns compressed/original size, the ratio compressFile weighs against
+// MinCompressRatio before committing to a full encode.
+func sampleCompressRatio(sample []byte, newEncoder func(w io.Writer) (io.WriteCloser, error)) (float64, error) {
+	if len(sample) == 0 {
+		return 0, nil
+	}
+	var buf bytes.Buffer
+	w, err := newEncoder(&buf)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(sample); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return float64(buf.Len()) / float64(len(sample)), nil
+}
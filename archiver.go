@@ -2,15 +2,24 @@ package archive
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"compress/gzip"
 	"encoding/csv"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 )
 
 // package level errors
@@ -22,12 +31,182 @@ var (
 	ErrContentTypeNotFound      = errors.New("content type not found")
 )
 
+// ArchiveFormat identifies the container/compression pairing CreateArchiveAs writes.
+type ArchiveFormat int
+
+// supported archive formats
+const (
+	Tar ArchiveFormat = iota
+	TarGz
+	TarBz2
+	TarXz
+	TarZstd
+	Zip
+)
+
+// formatFromExtension infers an ArchiveFormat from an output path's extension,
+// defaulting to TarGz when the extension is unrecognized.
+func formatFromExtension(p string) ArchiveFormat {
+	switch {
+	case strings.HasSuffix(p, ".zip"):
+		return Zip
+	case strings.HasSuffix(p, ".tar.bz2"), strings.HasSuffix(p, ".tbz2"):
+		return TarBz2
+	case strings.HasSuffix(p, ".tar.xz"), strings.HasSuffix(p, ".txz"):
+		return TarXz
+	case strings.HasSuffix(p, ".tar.zst"), strings.HasSuffix(p, ".tzst"):
+		return TarZstd
+	case strings.HasSuffix(p, ".tar"):
+		return Tar
+	default:
+		return TarGz
+	}
+}
+
+// archiveWriter abstracts the per-file emission step so the streaming tar-based
+// formats and the random-access zip writer can share CreateArchive/CreateArchiveAs.
+type archiveWriter interface {
+	WriteFile(fileInfo os.FileInfo, name string, r io.Reader) error
+	Close() error
+}
+
+// tarArchiveWriter writes a tar stream, optionally through a compressor.
+type tarArchiveWriter struct {
+	trw        *tar.Writer
+	compressor io.Closer // nil for plain Tar
+}
+
+func newTarArchiveWriter(w io.Writer, format ArchiveFormat) (*tarArchiveWriter, error) {
+	var (
+		out        io.Writer = w
+		compressor io.Closer
+	)
+	switch format {
+	case Tar:
+		// no compression layer
+	case TarGz:
+		gzw := gzip.NewWriter(w)
+		out, compressor = gzw, gzw
+	case TarBz2:
+		bzw, err := bzip2.NewWriter(w, nil)
+		if err != nil {
+			return nil, err
+		}
+		out, compressor = bzw, bzw
+	case TarXz:
+		xzw, err := xz.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		out, compressor = xzw, xzw
+	case TarZstd:
+		zstdw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		out, compressor = zstdw, zstdw
+	default:
+		return nil, fmt.Errorf("archive: unsupported tar format %v", format)
+	}
+	return &tarArchiveWriter{trw: tar.NewWriter(out), compressor: compressor}, nil
+}
+
+func (t *tarArchiveWriter) WriteFile(fileInfo os.FileInfo, name string, r io.Reader) error {
+	header, err := tar.FileInfoHeader(fileInfo, name)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.ModTime = fileInfo.ModTime()
+	header.AccessTime = fileInfo.ModTime()
+	header.ChangeTime = fileInfo.ModTime()
+	if err := t.trw.WriteHeader(header); err != nil {
+		return err
+	}
+	if fileInfo.IsDir() || r == nil {
+		return nil
+	}
+	_, err = io.Copy(t.trw, r)
+	return err
+}
+
+func (t *tarArchiveWriter) Close() error {
+	if err := t.trw.Close(); err != nil {
+		return err
+	}
+	if t.compressor != nil {
+		return t.compressor.Close()
+	}
+	return nil
+}
+
+// zipArchiveWriter writes zip entries followed by the central directory that
+// indexes them; archive/zip streams both to a plain io.Writer, so unlike the tar
+// formats it needs no separate compression layer.
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func newZipArchiveWriter(w io.Writer) *zipArchiveWriter {
+	return &zipArchiveWriter{zw: zip.NewWriter(w)}
+}
+
+func (z *zipArchiveWriter) WriteFile(fileInfo os.FileInfo, name string, r io.Reader) error {
+	header, err := zip.FileInfoHeader(fileInfo)
+	if err != nil {
+		return err
+	}
+	if fileInfo.IsDir() && !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	header.Modified = fileInfo.ModTime()
+	out, err := z.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if fileInfo.IsDir() || r == nil {
+		return nil
+	}
+	_, err = io.Copy(out, r)
+	return err
+}
+
+func (z *zipArchiveWriter) Close() error {
+	return z.zw.Close()
+}
+
+func newArchiveWriter(w io.Writer, format ArchiveFormat) (archiveWriter, error) {
+	if format == Zip {
+		return newZipArchiveWriter(w), nil
+	}
+	return newTarArchiveWriter(w, format)
+}
+
+// tempFile is a staged archive entry. object is the temp-file backing store and
+// is nil for directory entries, which carry no content. info overrides
+// object.Stat() when set; it is required for directory entries (whose FileInfo
+// cannot come from a temp file), used by AddReader to carry a caller-supplied
+// modTime, and used by AddFile/AddDir to carry the source file's mode and modTime.
 type tempFile struct {
 	name   string
 	object *os.File
+	info   os.FileInfo
+}
+
+// fileInfoWithModTime overrides ModTime() on an existing os.FileInfo so AddReader
+// can honor a caller-supplied modification time without hand-rolling the rest of
+// the os.FileInfo interface.
+type fileInfoWithModTime struct {
+	os.FileInfo
+	modTime time.Time
 }
 
-// Archiver is used to create tar.gz archives
+func (f fileInfoWithModTime) ModTime() time.Time { return f.modTime }
+
+// Archiver is used to create archives out of temporary files staged with AddCSV,
+// AddFile, AddDir, or AddReader
 type Archiver struct {
 	mtx         *sync.Mutex
 	filelist    []tempFile
@@ -101,57 +280,229 @@ func (a *Archiver) AddCSV(filename string, lines [][]string) error {
 	return nil
 }
 
-// CreateArchive moves all pending temporary files into a tar.gz
+// linkOrCopyToTemp stages srcPath under a new temp-file path without duplicating
+// multi-GB inputs where it can be avoided: it tries a hard link first, then a
+// symlink, and only falls back to a full copy when neither is possible (e.g.
+// srcPath is on a different filesystem and symlinks are unsupported).
+func linkOrCopyToTemp(srcPath string) (string, error) {
+	tmp, err := ioutil.TempFile("", "go_archiver_")
+	if err != nil {
+		return "", err
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	os.Remove(tmpName) // Link and Symlink require the destination to not exist
+	if err := os.Link(srcPath, tmpName); err == nil {
+		return tmpName, nil
+	}
+	// a relative symlink target would resolve against the temp dir, not the cwd
+	if absPath, err := filepath.Abs(srcPath); err == nil {
+		if err := os.Symlink(absPath, tmpName); err == nil {
+			return tmpName, nil
+		}
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.Create(tmpName)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return "", err
+	}
+	return tmpName, nil
+}
+
+// addFileLocked stages srcPath to be archived under nameInArchive. Callers must hold a.mtx.
+func (a *Archiver) addFileLocked(nameInArchive, srcPath string) error {
+	// keep srcPath's mode and modTime even when the temp file is a fresh copy
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	tmpName, err := linkOrCopyToTemp(srcPath)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(tmpName)
+	if err != nil {
+		return err
+	}
+	go a.deleteFileWhenDestroyed(tmpName)
+	a.filelist = append(a.filelist, tempFile{
+		name:   nameInArchive,
+		object: file,
+		info:   info,
+	})
+	return nil
+}
+
+// AddFile stages srcPath to be archived under nameInArchive when CreateArchive,
+// CreateArchiveAs, or CreateArchiveTo is called. Where possible it hard-links
+// (falling back to a symlink, then a full copy) so staging a multi-GB input
+// does not duplicate it on disk.
+func (a *Archiver) AddFile(nameInArchive, srcPath string) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.isDestroyed() {
+		return ErrArchiverHasBeenDestroyed
+	}
+	return a.addFileLocked(nameInArchive, srcPath)
+}
+
+// AddDir recursively stages files under srcDir matching rgx (all files if rgx is
+// nil) to be archived under nameInArchive, preserving relative paths and mode
+// bits. Directories are staged as their own entries so extraction recreates the
+// tree even for directories that contain no matching files.
+func (a *Archiver) AddDir(nameInArchive, srcDir string, rgx *regexp.Regexp) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.isDestroyed() {
+		return ErrArchiverHasBeenDestroyed
+	}
+	srcDir = filepath.Clean(srcDir)
+	return filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		name := nameInArchive
+		if rel != "." {
+			name = path.Join(nameInArchive, filepath.ToSlash(rel))
+		}
+		if info.IsDir() {
+			a.filelist = append(a.filelist, tempFile{name: name, info: info})
+			return nil
+		}
+		if rgx != nil && rgx.FindString(info.Name()) == "" {
+			return nil
+		}
+		return a.addFileLocked(name, p)
+	})
+}
+
+// AddReader copies r into a temporary file to be archived under nameInArchive
+// when CreateArchive, CreateArchiveAs, or CreateArchiveTo is called, recording
+// modTime as the archived entry's modification time.
+func (a *Archiver) AddReader(nameInArchive string, r io.Reader, modTime time.Time) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.isDestroyed() {
+		return ErrArchiverHasBeenDestroyed
+	}
+	file, err := ioutil.TempFile("", "go_archiver_")
+	if err != nil {
+		return err
+	}
+	go a.deleteFileWhenDestroyed(file.Name())
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	a.filelist = append(a.filelist, tempFile{
+		name:   nameInArchive,
+		object: file,
+		info:   fileInfoWithModTime{FileInfo: info, modTime: modTime},
+	})
+	return nil
+}
+
+// CreateArchive moves all pending temporary files into an archive, inferring
+// the format (tar, tar.gz, tar.bz2, tar.xz, tar.zst, or zip) from p's extension.
+// Use CreateArchiveAs to pick the format explicitly.
 func (a *Archiver) CreateArchive(p string) error {
+	return a.CreateArchiveAs(p, formatFromExtension(p))
+}
+
+// CreateArchiveAs moves all pending temporary files into an archive at p, written in format.
+func (a *Archiver) CreateArchiveAs(p string, format ArchiveFormat) error {
+	outputFile, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	return a.CreateArchiveTo(outputFile, format, nil)
+}
+
+// CreateArchiveTo streams all pending temporary files into w as an archive in the
+// given format, instead of always writing to a local file. This lets callers target
+// an HTTP response, an S3 uploader, or any other io.Writer sink. If progress is
+// non-nil it is called after each chunk is read from a file's source, reporting
+// source bytes consumed (not compressed bytes written) so UI progress bars track
+// the actual work remaining.
+func (a *Archiver) CreateArchiveTo(w io.Writer, format ArchiveFormat, progress func(fileName string, bytesWritten, totalBytes int64)) error {
 	a.mtx.Lock()
 	defer a.mtx.Unlock()
 	// no need to continue if there is nothing to archive
 	if len(a.filelist) == 0 {
 		return ErrNothingToArchive
 	}
-	// create an empty tar.gz file
-	p = strings.Split(p, ".")[0] + ".tar.gz"
-	outputFile, err := os.Create(p)
+	aw, err := newArchiveWriter(w, format)
 	if err != nil {
 		return err
 	}
-	defer outputFile.Close()
-	// create the gzip encoder
-	gzw := gzip.NewWriter(outputFile)
-	defer gzw.Close()
-	// create the tar encoder
-	trw := tar.NewWriter(gzw)
-	defer trw.Close()
+	defer aw.Close()
 	// iterate through every temporary file
 	for _, file := range a.filelist {
-		// prepare file deletion in case of an early exit
-		// note: this is safe to call more than once
-		defer os.Remove(file.object.Name())
-		// feed fileInfo into tar.WriteHeader()
-		fileInfo, err := file.object.Stat()
-		if err != nil {
-			return err
+		if file.object != nil {
+			// prepare file deletion in case of an early exit
+			// note: this is safe to call more than once
+			defer os.Remove(file.object.Name())
 		}
-		header, err := tar.FileInfoHeader(fileInfo, file.name)
-		if err != nil {
-			return err
+		fileInfo := file.info
+		if fileInfo == nil {
+			var err error
+			fileInfo, err = file.object.Stat()
+			if err != nil {
+				return err
+			}
 		}
-		// change the filename as the temporary filename is not valid
-		header.Name = file.name
-		header.ModTime = time.Now()
-		header.AccessTime = time.Now()
-		header.ChangeTime = time.Now()
-		err = trw.WriteHeader(header)
-		if err != nil {
-			return err
+		var src io.Reader
+		if file.object != nil {
+			src = file.object
+			if progress != nil {
+				src = &progressReader{r: file.object, name: file.name, total: fileInfo.Size(), progress: progress}
+			}
 		}
-		// push all file data into the tar encoder
-		_, err = io.Copy(trw, file.object)
-		if err != nil {
+		if err := aw.WriteFile(fileInfo, file.name, src); err != nil {
 			return err
 		}
 		// remove the object now that we are finished
-		os.Remove(file.object.Name())
+		if file.object != nil {
+			os.Remove(file.object.Name())
+		}
 	}
 	return nil
 }
+
+// progressReader wraps a file's source reader to report bytes consumed as an
+// archive is built, independent of how much compressed output those bytes produce.
+type progressReader struct {
+	r        io.Reader
+	name     string
+	total    int64
+	read     int64
+	progress func(fileName string, bytesWritten, totalBytes int64)
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	if n > 0 {
+		p.read += int64(n)
+		p.progress(p.name, p.read, p.total)
+	}
+	return n, err
+}
@@ -1,89 +1,52 @@
 package archive
 
 import (
-	"compress/gzip"
+	"bytes"
 	"io"
+	"io/fs"
 	"mime"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/golang/gddo/httputil/header"
 	"github.com/h2non/filetype"
-	"gopkg.in/kothar/brotli-go.v0/enc"
 )
 
-// CompressWebserverFiles recursively zips common webserver files in a given directory structure
-func CompressWebserverFiles(dir string) ([]string, error) {
-	return BrotliAndGzipFiles(dir, regexp.MustCompile(strings.Join(
-		[]string{"js", "css", "html", "json", "svg", "ico", "eot", "otf", "ttf", "woff"}, "$|")+"$",
-	))
-}
-
-// BrotliAndGzipFiles recursively compresses of all regex matched files in a given directory structure
-func BrotliAndGzipFiles(dir string, rgx *regexp.Regexp) ([]string, error) {
-	dir = filepath.Clean(dir)
-	fileInfo, err := os.Stat(dir)
-	if err != nil {
-		return nil, err
-	} else if !fileInfo.IsDir() {
-		return nil, ErrPathIsNotDirectory
-	}
-	var (
-		matches = []string{}
-		gzw     *gzip.Writer
-		brw     *enc.BrotliWriter
-	)
-	err = filepath.Walk(dir, func(p string, fileInfo os.FileInfo, err error) error {
-		if err == nil && !fileInfo.IsDir() && rgx.FindString(fileInfo.Name()) != "" {
-			inputFile, err := os.Open(p)
-			if err != nil {
-				return err
-			}
-			defer inputFile.Close()
-			matches = append(matches, p)
-			if filepath.Ext(p) != ".gz" && filepath.Ext(p) != ".br" {
-				gzOut, err := os.Create(p + ".gz")
-				if err != nil {
-					return err
-				}
-				defer gzOut.Close()
-				gzw, err = gzip.NewWriterLevel(gzOut, gzip.BestCompression)
-				if err != nil {
-					return err
-				}
-				io.Copy(gzw, inputFile)
-				gzw.Close()
-				brOut, err := os.Create(p + ".br")
-				if err != nil {
-					return err
-				}
-				defer brOut.Close()
-				brw = enc.NewBrotliWriter(nil, brOut)
-				inputFile.Seek(0, 0)
-				io.Copy(brw, inputFile)
-				brw.Close()
-			}
-		}
-		return nil
-	})
-	return matches, err
-}
-
 type fileHandler struct {
 	mtx              *sync.RWMutex
-	rootDir          http.Dir
+	fsys             fs.FS
 	contentTypeCache map[string]string
 }
 
 // FileServer will search for and serve compressed files if they are available
 func FileServer(root http.Dir) http.Handler {
+	return FileServerFS(dirFS{root})
+}
+
+// dirFS adapts an http.Dir to fs.FS: http.Dir.Open returns an http.File, not
+// an fs.File, so http.Dir does not itself satisfy fs.FS even though every
+// http.File already implements the fs.File method set.
+type dirFS struct {
+	d http.Dir
+}
+
+func (d dirFS) Open(name string) (fs.File, error) {
+	return d.d.Open(name)
+}
+
+// FileServerFS is like FileServer but serves out of an arbitrary fs.FS instead of
+// only the local filesystem, so callers can serve an embed.FS, an in-memory
+// fstest.MapFS, or a mounted tar/zip via an fs.FS adapter. This unlocks
+// single-binary deployments where compressed sidecars live inside an embedded
+// filesystem.
+func FileServerFS(fsys fs.FS) http.Handler {
 	return &fileHandler{
 		mtx:              &sync.RWMutex{},
-		rootDir:          root,
+		fsys:             fsys,
 		contentTypeCache: map[string]string{},
 	}
 }
@@ -105,7 +68,21 @@ func (f *fileHandler) cacheContentType(p, contentType string) {
 	return
 }
 
-func (f *fileHandler) determineContentType(p string, file http.File) string {
+// asReadSeeker returns file as an io.ReadSeeker. fs.FS only guarantees Read,
+// Stat, and Close, so files that don't already implement io.Seeker (unlike
+// *os.File or the files http.Dir hands back) are buffered into memory.
+func asReadSeeker(file fs.File) (io.ReadSeeker, error) {
+	if rs, ok := file.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (f *fileHandler) determineContentType(p string, content io.ReadSeeker, size int64) string {
 	contentType, _ := f.getCachedContentType(p)
 	if contentType != "" {
 		return contentType
@@ -115,72 +92,178 @@ func (f *fileHandler) determineContentType(p string, file http.File) string {
 		f.cacheContentType(p, contentType)
 		return contentType
 	}
-	typeMatch, _ := filetype.MatchFile(p)
+	typeMatch, _ := filetype.MatchReader(content)
+	content.Seek(0, io.SeekStart)
 	if typeMatch.MIME.Value != "" {
 		f.cacheContentType(p, typeMatch.MIME.Value)
 		return typeMatch.MIME.Value
 	}
-	var size int
-	fileInfo, err := file.Stat()
-	if err != nil && fileInfo.Size() < 512 {
-		size = int(fileInfo.Size())
-	} else {
-		size = 512
+	sniffSize := size
+	if sniffSize > 512 {
+		sniffSize = 512
 	}
-	bytes := make([]byte, size)
-	file.Read(bytes)
-	contentType = http.DetectContentType(bytes)
+	sniff := make([]byte, sniffSize)
+	n, _ := io.ReadFull(content, sniff)
+	content.Seek(0, io.SeekStart)
+	contentType = http.DetectContentType(sniff[:n])
 	f.cacheContentType(p, contentType)
 	return contentType
 }
 
+// encoders is ordered by preference when a client advertises more than one with
+// equal q-values: zstd compresses roughly 3x faster than brotli at a similar
+// ratio for text assets, so it now leads br, which in turn beats plain gzip.
 var (
-	encoders   = []string{"br", "gzip", ""}
-	extensions = []string{".br", ".gz", ""}
+	encoders   = []string{"zstd", "br", "gzip", ""}
+	extensions = []string{".zst", ".br", ".gz", ""}
 )
 
+// resolveAcceptEncoding parses specs (an already-parsed Accept-Encoding header)
+// per RFC 9110 §12.5.3 and returns the indices into encoders/extensions the
+// client accepts, ordered from most to least preferred. A q=0 forbids a coding
+// (including identity, whether named directly or via "*"); identity is
+// acceptable with q=1 unless a client explicitly says otherwise. An absent
+// header accepts every encoding in encoders' built-in preference order. Ties
+// keep that built-in order via a stable sort.
+func resolveAcceptEncoding(specs []header.AcceptSpec) []int {
+	if len(specs) == 0 {
+		order := make([]int, len(encoders))
+		for i := range encoders {
+			order[i] = i
+		}
+		return order
+	}
+	q := make([]float64, len(encoders))
+	acceptable := make([]bool, len(encoders))
+	// identityQ defaults to 1 per RFC 9110 §12.5.3, which means a client that
+	// advertises e.g. "br;q=0.5, zstd;q=1.0" without ever mentioning identity or
+	// "*" still ranks identity ahead of br and level with zstd, which keeps its
+	// place ahead of identity only by the built-in order (see
+	// TestResolveAcceptEncoding_IdentityDefaultOutranksExplicitLowerQ). That's a
+	// faithful reading of the spec, but it means a missing top-ranked sidecar
+	// (e.g. skipped by compressFile's MinCompressRatio heuristic) falls through
+	// to serving the uncompressed original instead of the next-best compressed
+	// one. Left as-is rather than reordering around spec, but worth knowing if
+	// compression ratios ever look worse than expected for such clients.
+	identityQ, identityExplicit, wildcardQ, hasWildcard := 1.0, false, 0.0, false
+	for _, spec := range specs {
+		switch spec.Value {
+		case "*":
+			wildcardQ, hasWildcard = spec.Q, true
+		case "identity":
+			identityQ, identityExplicit = spec.Q, true
+		default:
+			for i, e := range encoders {
+				if e != "" && e == spec.Value {
+					q[i], acceptable[i] = spec.Q, true
+				}
+			}
+		}
+	}
+	if hasWildcard {
+		for i, e := range encoders {
+			if e != "" && !acceptable[i] {
+				q[i], acceptable[i] = wildcardQ, true
+			}
+		}
+		if !identityExplicit {
+			identityQ = wildcardQ
+		}
+	}
+	for i, e := range encoders {
+		if e == "" {
+			q[i], acceptable[i] = identityQ, true
+		}
+	}
+	var order []int
+	for i := range encoders {
+		if acceptable[i] && q[i] > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return q[order[a]] > q[order[b]] })
+	return order
+}
+
 func (f *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	tryServingContent := func(enc, ext string) error {
-		p := r.URL.Path
-		if !strings.HasPrefix(p, "/") {
-			p = "/" + p
+	// A response to the same path can vary by which encoding was chosen, so
+	// caches must key on Accept-Encoding regardless of which branch below fires.
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	p := r.URL.Path
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	p = path.Clean(p)
+	if p == "/" {
+		p = "/index.html"
+	}
+	name := strings.TrimPrefix(p, "/")
+
+	// open opens name+ext and reports whether it names a servable file, without
+	// writing anything to w. It's shared by tryServingContent and the 404/406
+	// decision below so both agree on what "the resource exists" means.
+	open := func(ext string) (fs.File, fs.FileInfo, error) {
+		file, err := f.fsys.Open(filepath.FromSlash(name + ext))
+		if err != nil {
+			return nil, nil, err
+		}
+		fileInfo, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, nil, err
 		}
-		if p == "/" {
-			p = "/index.html"
+		if fileInfo.IsDir() {
+			file.Close()
+			return nil, nil, ErrPathIsDirectory
 		}
-		originalPath := p
-		p = filepath.FromSlash(p + ext)
-		p = strings.Replace(p, "\\", "/", -1) // for Windows
-		file, err := f.rootDir.Open(p)
+		return file, fileInfo, nil
+	}
+
+	// tryServingContent opens name+ext and falls through on any error, so a
+	// .gz/.br/.zst sidecar that CompressFiles skipped (MinCompressRatio, MinSize)
+	// is handled the same way as one that was never generated: ServeHTTP just
+	// moves on to the next acceptable encoding.
+	tryServingContent := func(ext string) error {
+		file, fileInfo, err := open(ext)
 		if err != nil {
 			return err
 		}
 		defer file.Close()
-		fileInfo, err := file.Stat()
+		content, err := asReadSeeker(file)
 		if err != nil {
 			return err
 		}
-		if fileInfo.IsDir() {
-			return ErrPathIsDirectory
-		}
-		w.Header().Set("Content-Encoding", enc)
-		w.Header().Set("Content-Type", f.determineContentType(originalPath, file))
-		http.ServeContent(w, r, r.URL.Path, fileInfo.ModTime(), file)
+		w.Header().Set("Content-Type", f.determineContentType(p, content, fileInfo.Size()))
+		http.ServeContent(w, r, r.URL.Path, fileInfo.ModTime(), content)
 		return nil
 	}
-	specs := header.ParseAccept(r.Header, "Accept-Encoding")
-	for i := range encoders {
-		if len(specs) == 0 {
-			if tryServingContent(encoders[i], extensions[i]) == nil {
-				return
-			}
+
+	order := resolveAcceptEncoding(header.ParseAccept(r.Header, "Accept-Encoding"))
+	identityAcceptable := false
+	for _, i := range order {
+		if extensions[i] == "" {
+			identityAcceptable = true
 		}
-		for _, spec := range specs {
-			if spec.Value == encoders[i] && spec.Q > 0 || extensions[i] == "" {
-				if tryServingContent(encoders[i], extensions[i]) == nil {
-					return
-				}
-			}
+		if encoders[i] != "" {
+			w.Header().Set("Content-Encoding", encoders[i])
+		}
+		if tryServingContent(extensions[i]) == nil {
+			return
+		}
+		w.Header().Del("Content-Encoding")
+	}
+
+	// Every acceptable encoding was tried and none had a file. If identity was
+	// acceptable, that covered the uncompressed original too, so the resource
+	// genuinely doesn't exist. Otherwise the client forbade identity (e.g.
+	// "identity;q=0") while only offering codings we can't serve this resource
+	// in; distinguish that 406 case from a real 404 by checking identity directly.
+	if !identityAcceptable {
+		if file, _, err := open(""); err == nil {
+			file.Close()
+			http.Error(w, "no acceptable content-encoding available", http.StatusNotAcceptable)
+			return
 		}
 	}
 	http.NotFound(w, r)
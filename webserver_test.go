@@ -0,0 +1,130 @@
+package archive
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/golang/gddo/httputil/header"
+)
+
+// parseAcceptEncoding builds the []header.AcceptSpec resolveAcceptEncoding
+// expects, the same way ServeHTTP does from a real request header.
+func parseAcceptEncoding(v string) []header.AcceptSpec {
+	h := http.Header{}
+	if v != "" {
+		h.Set("Accept-Encoding", v)
+	}
+	return header.ParseAccept(h, "Accept-Encoding")
+}
+
+func encIndex(t *testing.T, name string) int {
+	t.Helper()
+	for i, e := range encoders {
+		if e == name {
+			return i
+		}
+	}
+	t.Fatalf("no encoder named %q", name)
+	return -1
+}
+
+// TestResolveAcceptEncoding_ZstdPreferredOverBrotli covers the test matrix the
+// zstd-as-first-class-encoding request called for: whichever of zstd/br
+// carries the higher q-value should rank first, independent of identity's
+// own position in the result.
+func TestResolveAcceptEncoding_ZstdPreferredOverBrotli(t *testing.T) {
+	zstdIdx := encIndex(t, "zstd")
+	brIdx := encIndex(t, "br")
+
+	tests := []struct {
+		name          string
+		header        string
+		wantZstdFirst bool
+	}{
+		{"zstd has the higher q", "zstd;q=1.0, br;q=0.5", true},
+		{"br has the higher q", "br;q=1.0, zstd;q=0.5", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := resolveAcceptEncoding(parseAcceptEncoding(tt.header))
+			zPos, bPos := -1, -1
+			for pos, idx := range order {
+				if idx == zstdIdx {
+					zPos = pos
+				}
+				if idx == brIdx {
+					bPos = pos
+				}
+			}
+			if zPos == -1 || bPos == -1 {
+				t.Fatalf("header %q: expected both zstd and br acceptable, got order %v", tt.header, order)
+			}
+			if (zPos < bPos) != tt.wantZstdFirst {
+				t.Errorf("header %q: zstd at %d, br at %d; wanted zstd-first=%v", tt.header, zPos, bPos, tt.wantZstdFirst)
+			}
+		})
+	}
+}
+
+// orderNames renders resolveAcceptEncoding's result as encoder names
+// ("identity" standing in for the "" entry) for readable test failures.
+func orderNames(order []int) []string {
+	names := make([]string, len(order))
+	for i, idx := range order {
+		if encoders[idx] == "" {
+			names[i] = "identity"
+		} else {
+			names[i] = encoders[idx]
+		}
+	}
+	return names
+}
+
+// TestResolveAcceptEncoding covers realistic Accept-Encoding strings,
+// including the absent-header default, q=0 exclusions (named and wildcard),
+// and wildcard fill-in.
+func TestResolveAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []string
+	}{
+		{"absent header accepts everything in built-in preference order", "", []string{"zstd", "br", "gzip", "identity"}},
+		{"identity;q=0 with no other codings leaves nothing acceptable", "identity;q=0", nil},
+		{"*;q=0 forbids every coding, identity included", "*;q=0", nil},
+		{"*;q=0.5 fills in every coding at the same q, built-in order preserved", "*;q=0.5", []string{"zstd", "br", "gzip", "identity"}},
+		{"gzip alone also leaves identity acceptable at its default q", "gzip", []string{"gzip", "identity"}},
+		{"gzip;q=0 combined with a wildcard excludes only gzip", "gzip;q=0, *;q=1", []string{"zstd", "br", "identity"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := orderNames(resolveAcceptEncoding(parseAcceptEncoding(tt.header)))
+			if len(got) != len(tt.want) {
+				t.Fatalf("header %q: got %v, want %v", tt.header, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("header %q: got %v, want %v", tt.header, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestResolveAcceptEncoding_IdentityDefaultOutranksExplicitLowerQ pins down
+// the tradeoff called out next to identityQ's default: a client that never
+// mentions identity or "*" gets identity at an implicit q=1, which outranks
+// an explicitly but lower-q named coding even though the client clearly
+// prefers that coding over the uncompressed original.
+func TestResolveAcceptEncoding_IdentityDefaultOutranksExplicitLowerQ(t *testing.T) {
+	got := orderNames(resolveAcceptEncoding(parseAcceptEncoding("br;q=0.5, zstd;q=1.0")))
+	want := []string{"zstd", "identity", "br"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}